@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/codahale/hdrhistogram"
+)
+
+const (
+	// hlogCookieV2 identifies the uncompressed V2 payload (header + counts)
+	// wrapped inside the compressed blob below.
+	hlogCookieV2 = 0x1c849303
+	// hlogCompressedCookieV2 identifies the outer compressed-blob format
+	// that HistogramLogReader expects each interval's field to start with;
+	// it decodes from the "HISTFAAA..." prefix real HdrHistogram logs use.
+	hlogCompressedCookieV2 = 0x1c849314
+)
+
+// HdrLogWriter appends interval histograms to a file in the standard
+// HdrHistogram log format (V1.3 header, one "Tag=..." line per interval),
+// so external tools such as HdrHistogramPlotter can plot latency-over-time
+// while the run is still in progress.
+type HdrLogWriter struct {
+	file      *os.File
+	startTime time.Time
+}
+
+// NewHdrLogWriter creates path (truncating any existing file) and writes
+// the V1.3 header, using startTime for both StartTime and BaseTime.
+func NewHdrLogWriter(path string, startTime time.Time) (*HdrLogWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	startSec := float64(startTime.UnixNano()) / 1e9
+	fmt.Fprintln(f, "#[Histogram log format version 1.3]")
+	fmt.Fprintf(f, "#[StartTime: %.3f (seconds since epoch)]\n", startSec)
+	fmt.Fprintf(f, "#[BaseTime: %.3f (seconds since epoch)]\n", startSec)
+
+	return &HdrLogWriter{file: f, startTime: startTime}, nil
+}
+
+// hdrLogPathForOp derives a per-op-type path from base, e.g. "run.hlog" and
+// "write" become "run-write.hlog", for use with --hdr-latency-file-per-op.
+func hdrLogPathForOp(base, opType string) string {
+	ext := filepath.Ext(base)
+	trimmed := strings.TrimSuffix(base, ext)
+	return fmt.Sprintf("%s-%s%s", trimmed, opType, ext)
+}
+
+// WriteInterval appends one interval record covering
+// [start, start+duration) for hist, and flushes so the log stays readable
+// by tools while the benchmark keeps running. hist is nil whenever
+// --measure-latency is off; WriteInterval then skips the interval rather
+// than encoding an empty histogram.
+func (w *HdrLogWriter) WriteInterval(tag string, start time.Time, duration time.Duration, hist *hdrhistogram.Histogram) error {
+	if hist == nil {
+		return nil
+	}
+
+	encoded, err := encodeHistogramV2(hist)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w.file, "Tag=%s,%.3f,%.3f,%.3f,%s\n",
+		tag, start.Sub(w.startTime).Seconds(), duration.Seconds(), float64(hist.Max())/1e6, encoded)
+	if err != nil {
+		return err
+	}
+	return w.file.Sync()
+}
+
+func (w *HdrLogWriter) Close() error {
+	return w.file.Close()
+}
+
+// encodeHistogramV2 produces the base64 blob used in the HdrHistogram V2
+// interval log format: an outer [compressed cookie][length] header wrapping
+// a zlib-deflated V2 payload, itself a fixed-size header (cookie,
+// significant figures, value range, conversion ratio) followed by the
+// histogram's bucket counts, each ZigZag/LEB128 varint encoded.
+// HistogramLogReader validates the outer compressed cookie before it will
+// even look at the deflated bytes, so both layers are required.
+func encodeHistogramV2(hist *hdrhistogram.Histogram) (string, error) {
+	snap := hist.Export()
+
+	var counts bytes.Buffer
+	for _, c := range snap.Counts {
+		writeZigZagLEB128(&counts, c)
+	}
+
+	var payload bytes.Buffer
+	writeInt32(&payload, hlogCookieV2)
+	writeInt32(&payload, int32(counts.Len()))
+	writeInt32(&payload, 0) // normalizing index offset
+	writeInt32(&payload, int32(snap.SignificantFigures))
+	writeInt64(&payload, snap.LowestTrackableValue)
+	writeInt64(&payload, snap.HighestTrackableValue)
+	writeDouble(&payload, 1.0) // integerToDoubleValueConversionRatio
+	payload.Write(counts.Bytes())
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(payload.Bytes()); err != nil {
+		return "", err
+	}
+	if err := zw.Close(); err != nil {
+		return "", err
+	}
+
+	var wrapped bytes.Buffer
+	writeInt32(&wrapped, hlogCompressedCookieV2)
+	writeInt32(&wrapped, int32(compressed.Len()))
+	wrapped.Write(compressed.Bytes())
+
+	return base64.StdEncoding.EncodeToString(wrapped.Bytes()), nil
+}
+
+func writeInt32(buf *bytes.Buffer, v int32) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeInt64(buf *bytes.Buffer, v int64) {
+	binary.Write(buf, binary.BigEndian, v)
+}
+
+func writeDouble(buf *bytes.Buffer, v float64) {
+	binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+}
+
+// writeZigZagLEB128 encodes v the way the HdrHistogram wire format encodes
+// bucket counts: ZigZag maps the signed value onto the unsigned range, then
+// LEB128 stores it with the continuation bit in the top bit of each byte.
+func writeZigZagLEB128(buf *bytes.Buffer, v int64) {
+	zz := uint64((v << 1) ^ (v >> 63))
+	for {
+		b := byte(zz & 0x7f)
+		zz >>= 7
+		if zz != 0 {
+			buf.WriteByte(b | 0x80)
+		} else {
+			buf.WriteByte(b)
+			break
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/codahale/hdrhistogram"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+var (
+	opsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sb_operations_total",
+		Help: "Total number of completed operations.",
+	}, []string{"op", "table", "status"})
+
+	rowsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sb_rows_total",
+		Help: "Total number of rows processed.",
+	}, []string{"op", "table"})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sb_errors_total",
+		Help: "Total number of errors, broken down by error class.",
+	}, []string{"op", "table", "error_class"})
+
+	// A GaugeVec, not a HistogramVec: the request specifies an explicit
+	// quantile label, which is how it's set per ResultBuilder's partial
+	// window below rather than left to Prometheus's own bucket math.
+	latencySeconds = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "sb_latency_seconds",
+		Help: "Operation latency in seconds, at the given quantile.",
+	}, []string{"op", "table", "quantile"})
+
+	hostErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "sb_host_errors_total",
+		Help: "Total number of errors returned by each coordinator host.",
+	}, []string{"host"})
+)
+
+func init() {
+	prometheus.MustRegister(opsTotal, rowsTotal, errorsTotal, latencySeconds, hostErrorsTotal)
+}
+
+var latencyQuantiles = []float64{50, 90, 99}
+
+// recordLatencyQuantiles sets sb_latency_seconds{op,table,quantile} from
+// hist's current snapshot. RunTest calls this once per partial-result
+// window (the same cadence PartialResult already ticks on), so it reports
+// the latency distribution over roughly the last second rather than an
+// instantaneous single observation.
+func recordLatencyQuantiles(opType, table string, hist *hdrhistogram.Histogram) {
+	if hist == nil {
+		return
+	}
+	for _, q := range latencyQuantiles {
+		value := float64(hist.ValueAtQuantile(q)) / 1e9
+		latencySeconds.WithLabelValues(opType, table, strconv.FormatFloat(q/100, 'f', -1, 64)).Set(value)
+	}
+}
+
+var prometheusServerOnce sync.Once
+
+// StartPrometheusServer starts the /metrics endpoint for the standard pull
+// model, if --prometheus-listen was given. It is safe to call on every
+// RunConcurrently invocation; the server is only ever started once.
+func StartPrometheusServer() {
+	if prometheusListenAddress == "" {
+		return
+	}
+	prometheusServerOnce.Do(func() {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		go func() {
+			if err := http.ListenAndServe(prometheusListenAddress, mux); err != nil {
+				log.Print(err)
+			}
+		}()
+	})
+}
+
+// pushMetricsIfEnabled pushes the registered metrics to the pushgateway
+// configured via --prometheus-pushgateway. It is a no-op unless that flag
+// was given, so the pull-based /metrics endpoint remains the default path.
+func pushMetricsIfEnabled(job string) {
+	if prometheusPushGatewayAddress == "" {
+		return
+	}
+	if err := push.New(prometheusPushGatewayAddress, job).Gatherer(prometheus.DefaultGatherer).Push(); err != nil {
+		log.Print(err)
+	}
+}
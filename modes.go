@@ -4,14 +4,12 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/codahale/hdrhistogram"
 	"github.com/gocql/gocql"
-
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/push"
 )
 
 type RateLimiter interface {
@@ -47,6 +45,9 @@ func (mxrl *MaximumRateLimiter) ExpectedInterval() int64 {
 }
 
 func NewRateLimiter(maximumRate int, timeOffset time.Duration) RateLimiter {
+	if rateLimitMode == "adaptive" {
+		return NewAdaptiveRateLimiter(maximumRate, errorThreshold, latencySLO)
+	}
 	if maximumRate == 0 {
 		return &UnlimitedRateLimiter{}
 	}
@@ -54,6 +55,151 @@ func NewRateLimiter(maximumRate int, timeOffset time.Duration) RateLimiter {
 	return &MaximumRateLimiter{period, time.Now(), 0}
 }
 
+// AdaptiveRateLimiter paces requests off the EWMA-smoothed latency and
+// error rate observed from the server, rather than off a fixed period: it
+// backs off multiplicatively once the server shows signs of overload, and
+// recovers additively once those signs clear. It implements the same
+// RateLimiter interface as MaximumRateLimiter, so the correction-for-
+// coordinated-omission path in ResultBuilder.RecordLatency keeps working
+// unchanged.
+type AdaptiveRateLimiter struct {
+	UserMaxPeriod  time.Duration
+	SafetyFactor   float64
+	ErrorThreshold float64
+	LatencySLO     time.Duration
+	Alpha          float64
+	BackoffFactor  float64
+	RecoveryStep   time.Duration
+
+	mu            sync.Mutex
+	period        time.Duration
+	ewmaLatency   time.Duration
+	lastRequest   time.Time
+	windowOps     int64
+	windowErrors  int64
+	windowLatency *hdrhistogram.Histogram
+	windowStart   time.Time
+}
+
+// NewAdaptiveRateLimiter builds a limiter with a safety factor of 1.0, a
+// backoff factor of 1.5 and a 1ms recovery step, all of which are user-
+// tunable after construction. userMaxRate of 0 means no hard ceiling; the
+// limiter will still throttle based on latency and error rate.
+func NewAdaptiveRateLimiter(userMaxRate int, errorThreshold float64, latencySLO time.Duration) *AdaptiveRateLimiter {
+	var userMaxPeriod time.Duration
+	if userMaxRate != 0 {
+		userMaxPeriod = time.Duration(int64(time.Second) / int64(userMaxRate))
+	}
+	return &AdaptiveRateLimiter{
+		UserMaxPeriod:  userMaxPeriod,
+		SafetyFactor:   1.0,
+		ErrorThreshold: errorThreshold,
+		LatencySLO:     latencySLO,
+		Alpha:          0.1,
+		BackoffFactor:  1.5,
+		RecoveryStep:   time.Millisecond,
+		period:         userMaxPeriod,
+		windowLatency:  NewHistogram(),
+		windowStart:    time.Now(),
+	}
+}
+
+func (arl *AdaptiveRateLimiter) Wait() {
+	arl.mu.Lock()
+	period := arl.period
+	last := arl.lastRequest
+	arl.lastRequest = time.Now()
+	arl.mu.Unlock()
+
+	if last.IsZero() {
+		return
+	}
+	if next := last.Add(period); time.Now().Before(next) {
+		time.Sleep(time.Until(next))
+	}
+}
+
+func (arl *AdaptiveRateLimiter) ExpectedInterval() int64 {
+	arl.mu.Lock()
+	defer arl.mu.Unlock()
+	return arl.period.Nanoseconds()
+}
+
+// RecordLatency feeds a completed operation's latency and outcome into the
+// EWMAs driving the limiter's target period. It is called from RunTest in
+// addition to ResultBuilder.RecordLatency whenever --rate-limit-mode=adaptive
+// is selected. A limiter instance belongs to exactly one worker (RunTest
+// calls Wait/RecordLatency serially from within that worker's goroutine),
+// so the target period is simply the worker's own EWMA latency: aggregate
+// throughput scales with the number of workers on its own.
+func (arl *AdaptiveRateLimiter) RecordLatency(latency time.Duration, isError bool) {
+	arl.mu.Lock()
+	defer arl.mu.Unlock()
+
+	if arl.ewmaLatency == 0 {
+		arl.ewmaLatency = latency
+	} else {
+		arl.ewmaLatency = time.Duration(arl.Alpha*float64(latency) + (1-arl.Alpha)*float64(arl.ewmaLatency))
+	}
+
+	arl.windowOps++
+	if isError {
+		arl.windowErrors++
+	}
+	if arl.windowLatency != nil {
+		arl.windowLatency.RecordValue(latency.Nanoseconds())
+	}
+
+	if time.Since(arl.windowStart) < time.Second {
+		return
+	}
+
+	targetPeriod := time.Duration(float64(arl.ewmaLatency) * arl.SafetyFactor)
+	if targetPeriod < arl.UserMaxPeriod {
+		targetPeriod = arl.UserMaxPeriod
+	}
+
+	overloaded := arl.windowOps > 0 && float64(arl.windowErrors)/float64(arl.windowOps) > arl.ErrorThreshold
+	if !overloaded && arl.LatencySLO > 0 && arl.windowLatency != nil {
+		overloaded = time.Duration(arl.windowLatency.ValueAtQuantile(99)) > arl.LatencySLO
+	}
+
+	switch {
+	case overloaded:
+		// arl.period starts at zero whenever --max-rate is unset, and
+		// multiplying zero by BackoffFactor never throttles; seed it from
+		// the latency-derived target (or a minimum floor) before backing off.
+		period := arl.period
+		if period <= 0 {
+			period = targetPeriod
+		}
+		if period <= 0 {
+			period = time.Millisecond
+		}
+		arl.period = time.Duration(float64(period) * arl.BackoffFactor)
+	case arl.period > targetPeriod:
+		arl.period -= arl.RecoveryStep
+		if arl.period < targetPeriod {
+			arl.period = targetPeriod
+		}
+	default:
+		arl.period = targetPeriod
+	}
+
+	arl.windowOps = 0
+	arl.windowErrors = 0
+	arl.windowLatency = NewHistogram()
+	arl.windowStart = time.Now()
+}
+
+// recordAdaptiveFeedback feeds latency back into rateLimiter if it is an
+// AdaptiveRateLimiter; it is a no-op for every other RateLimiter.
+func recordAdaptiveFeedback(rateLimiter RateLimiter, latency time.Duration, isError bool) {
+	if arl, ok := rateLimiter.(*AdaptiveRateLimiter); ok {
+		arl.RecordLatency(latency, isError)
+	}
+}
+
 type Result struct {
 	Final          bool
 	ElapsedTime    time.Duration
@@ -135,7 +281,7 @@ func MergeResults(results []chan Result) (bool, *MergedResult) {
 	return final, result
 }
 
-func RunConcurrently(name string, maximumRate int, workload func(id int, resultChannel chan Result, rateLimiter RateLimiter)) *MergedResult {
+func RunConcurrently(name string, maximumRate int, totalOps int64, workload func(id int, resultChannel chan Result, rateLimiter RateLimiter)) *MergedResult {
 	var timeOffsetUnit int64
 	if maximumRate != 0 {
 		timeOffsetUnit = int64(time.Second) / int64(maximumRate)
@@ -158,53 +304,87 @@ func RunConcurrently(name string, maximumRate int, workload func(id int, resultC
 		}(i)
 	}
 
-	lat_max := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "lat_max",
-		Help: "Highest latency",
-	})
+	StartPrometheusServer()
 
-	lat_99 := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "lat_99",
-		Help: "99th percentile latency",
-	})
-
-	lat_90 := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "lat_90",
-		Help: "90th percentile latency",
-	})
+	var hdrWriter *HdrLogWriter
+	if hdrLatencyFile != "" {
+		path := hdrLatencyFile
+		if hdrLatencyFilePerOp {
+			path = hdrLogPathForOp(hdrLatencyFile, name)
+		}
+		var err error
+		hdrWriter, err = NewHdrLogWriter(path, startTime)
+		if err != nil {
+			log.Print(err)
+			hdrWriter = nil
+		} else {
+			defer hdrWriter.Close()
+		}
+	}
 
-	lat_50 := prometheus.NewGauge(prometheus.GaugeOpts{
-		Name: "lat_50",
-		Help: "50th percentile latency",
-	})
+	// Interval histograms are written from the aggregated per-tick result
+	// below, which already merges every worker's PartialResult; there is no
+	// need for RunTest to write its own, per-worker interval.
+	lastTick := startTime
+	progress := NewProgressReporter(totalOps)
 
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(lat_max, lat_99, lat_90, lat_50)
-	pusher := push.New("http://127.0.0.1:9091", name).Gatherer(registry)
+	resultSink, err := NewResultSink(resultFormat, resultFile)
+	if err != nil {
+		log.Print(err)
+		resultSink = &ResultSink{format: "text"}
+	}
+	defer resultSink.Close()
 
 	final, result := MergeResults(results)
 	for !final {
-		result.Time = time.Now().Sub(startTime)
+		now := time.Now()
+		result.Time = now.Sub(startTime)
+		tickElapsed := now.Sub(lastTick)
+
+		if hdrWriter != nil {
+			if err := hdrWriter.WriteInterval(name, lastTick, tickElapsed, result.Latency); err != nil {
+				log.Print(err)
+			}
+		}
+		lastTick = now
+
+		// The ETA line is prose, not a machine-readable record; printing it
+		// unconditionally would interleave it into the NDJSON/CSV stream
+		// whenever --result-file is unset and that stream also goes to
+		// stdout, so it's gated to the text format.
+		if resultFormat == "text" {
+			if eta := progress.Tick(int64(result.Operations), tickElapsed); eta != "" {
+				fmt.Println(eta)
+			}
+		}
 
-		lat_max.Set(float64(result.Latency.Max()))
-		lat_99.Set(float64(result.Latency.ValueAtQuantile(99)))
-		lat_90.Set(float64(result.Latency.ValueAtQuantile(90)))
-		lat_50.Set(float64(result.Latency.ValueAtQuantile(50)))
-		pusher.Push()
+		pushMetricsIfEnabled(name)
 
-		PrintPartialResult(result)
+		if resultFormat == "text" {
+			PrintPartialResult(result)
+		} else if err := resultSink.Write(result, false); err != nil {
+			log.Print(err)
+		}
 		final, result = MergeResults(results)
 	}
+
+	if resultFormat != "text" {
+		if err := resultSink.Write(result, true); err != nil {
+			log.Print(err)
+		}
+	}
 	return result
 }
 
 type ResultBuilder struct {
+	OpType        string
+	Table         string
 	FullResult    *Result
 	PartialResult *Result
 }
 
-func NewResultBuilder() *ResultBuilder {
-	rb := &ResultBuilder{}
+func NewResultBuilder(opType, table string) *ResultBuilder {
+	rb := &ResultBuilder{OpType: opType, Table: table}
 	rb.FullResult = &Result{}
 	rb.PartialResult = &Result{}
 	rb.FullResult.Final = true
@@ -216,21 +396,26 @@ func NewResultBuilder() *ResultBuilder {
 func (rb *ResultBuilder) IncOps() {
 	rb.FullResult.Operations++
 	rb.PartialResult.Operations++
+	opsTotal.WithLabelValues(rb.OpType, rb.Table, "ok").Inc()
 }
 
 func (rb *ResultBuilder) IncRows() {
 	rb.FullResult.ClusteringRows++
 	rb.PartialResult.ClusteringRows++
+	rowsTotal.WithLabelValues(rb.OpType, rb.Table).Inc()
 }
 
 func (rb *ResultBuilder) AddRows(n int) {
 	rb.FullResult.ClusteringRows += n
 	rb.PartialResult.ClusteringRows += n
+	rowsTotal.WithLabelValues(rb.OpType, rb.Table).Add(float64(n))
 }
 
-func (rb *ResultBuilder) IncErrors() {
+func (rb *ResultBuilder) IncErrors(err error) {
 	rb.FullResult.Errors++
 	rb.PartialResult.Errors++
+	opsTotal.WithLabelValues(rb.OpType, rb.Table, "error").Inc()
+	errorsTotal.WithLabelValues(rb.OpType, rb.Table, errorClass(err)).Inc()
 }
 
 func (rb *ResultBuilder) ResetPartialResult() {
@@ -256,10 +441,16 @@ func (rb *ResultBuilder) RecordLatency(latency time.Duration, rateLimiter RateLi
 	return nil
 }
 
+// errorClass reduces an error to a coarse, low-cardinality label suitable
+// for the sb_errors_total metric.
+func errorClass(err error) string {
+	return fmt.Sprintf("%T", err)
+}
+
 var errorRecordingLatency bool
 
-func RunTest(resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, test func(rb *ResultBuilder) (error, time.Duration)) {
-	rb := NewResultBuilder()
+func RunTest(opType, table string, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, test func(rb *ResultBuilder) (error, time.Duration)) {
+	rb := NewResultBuilder(opType, table)
 
 	start := time.Now()
 	partialStart := start
@@ -269,9 +460,11 @@ func RunTest(resultChannel chan Result, workload WorkloadGenerator, rateLimiter
 		err, latency := test(rb)
 		if err != nil {
 			log.Print(err)
-			rb.IncErrors()
+			rb.IncErrors(err)
+			recordAdaptiveFeedback(rateLimiter, latency, true)
 			continue
 		}
+		recordAdaptiveFeedback(rateLimiter, latency, false)
 
 		err = rb.RecordLatency(latency, rateLimiter)
 		if err != nil {
@@ -280,6 +473,7 @@ func RunTest(resultChannel chan Result, workload WorkloadGenerator, rateLimiter
 
 		now := time.Now()
 		if now.Sub(partialStart) > time.Second {
+			recordLatencyQuantiles(rb.OpType, rb.Table, rb.PartialResult.Latency)
 			resultChannel <- *rb.PartialResult
 			rb.ResetPartialResult()
 			partialStart = now
@@ -291,11 +485,12 @@ func RunTest(resultChannel chan Result, workload WorkloadGenerator, rateLimiter
 	resultChannel <- *rb.FullResult
 }
 
-func DoWrites(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter) {
+func DoWrites(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, retryPolicy *ReplicaRetryPolicy) {
 	value := make([]byte, clusteringRowSize)
-	query := session.Query("INSERT INTO " + keyspaceName + "." + tableName + " (pk, ck, v) VALUES (?, ?, ?)")
+	query := session.Query("INSERT INTO "+keyspaceName+"."+tableName+" (pk, ck, v) VALUES (?, ?, ?)").
+		RetryPolicy(retryPolicy).Observer(retryPolicy)
 
-	RunTest(resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
+	RunTest("write", tableName, resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
 		pk := workload.NextPartitionKey()
 		ck := workload.NextClusteringKey()
 		bound := query.Bind(pk, ck, value)
@@ -315,12 +510,14 @@ func DoWrites(session *gocql.Session, resultChannel chan Result, workload Worklo
 	})
 }
 
-func DoBatchedWrites(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter) {
+func DoBatchedWrites(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, retryPolicy *ReplicaRetryPolicy) {
 	value := make([]byte, clusteringRowSize)
 	request := fmt.Sprintf("INSERT INTO %s.%s (pk, ck, v) VALUES (?, ?, ?)", keyspaceName, tableName)
 
-	RunTest(resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
+	RunTest("batch_write", tableName, resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
 		batch := gocql.NewBatch(gocql.UnloggedBatch)
+		batch.RetryPolicy(retryPolicy)
+		batch.Observer(retryPolicy)
 		batchSize := 0
 
 		currentPk := workload.NextPartitionKey()
@@ -345,10 +542,11 @@ func DoBatchedWrites(session *gocql.Session, resultChannel chan Result, workload
 	})
 }
 
-func DoCounterUpdates(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter) {
-	query := session.Query("UPDATE " + keyspaceName + "." + counterTableName + " SET c1 = c1 + 1, c2 = c2 + 1, c3 = c3 + 1, c4 = c4 + 1, c5 = c5 + 1 WHERE pk = ? AND ck = ?")
+func DoCounterUpdates(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, retryPolicy *ReplicaRetryPolicy) {
+	query := session.Query("UPDATE "+keyspaceName+"."+counterTableName+" SET c1 = c1 + 1, c2 = c2 + 1, c3 = c3 + 1, c4 = c4 + 1, c5 = c5 + 1 WHERE pk = ? AND ck = ?").
+		RetryPolicy(retryPolicy).Observer(retryPolicy)
 
-	RunTest(resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
+	RunTest("counter_update", counterTableName, resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
 		pk := workload.NextPartitionKey()
 		ck := workload.NextClusteringKey()
 		bound := query.Bind(pk, ck)
@@ -368,15 +566,15 @@ func DoCounterUpdates(session *gocql.Session, resultChannel chan Result, workloa
 	})
 }
 
-func DoReads(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter) {
-	DoReadsFromTable(tableName, session, resultChannel, workload, rateLimiter)
+func DoReads(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, retryPolicy *ReplicaRetryPolicy) {
+	DoReadsFromTable(tableName, session, resultChannel, workload, rateLimiter, retryPolicy)
 }
 
-func DoCounterReads(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter) {
-	DoReadsFromTable(counterTableName, session, resultChannel, workload, rateLimiter)
+func DoCounterReads(session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, retryPolicy *ReplicaRetryPolicy) {
+	DoReadsFromTable(counterTableName, session, resultChannel, workload, rateLimiter, retryPolicy)
 }
 
-func DoReadsFromTable(table string, session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter) {
+func DoReadsFromTable(table string, session *gocql.Session, resultChannel chan Result, workload WorkloadGenerator, rateLimiter RateLimiter, retryPolicy *ReplicaRetryPolicy) {
 	var request string
 	if inRestriction {
 		arr := make([]string, rowsPerRequest)
@@ -391,9 +589,14 @@ func DoReadsFromTable(table string, session *gocql.Session, resultChannel chan R
 	} else {
 		request = fmt.Sprintf("SELECT * FROM %s.%s WHERE pk = ? AND ck >= ? LIMIT %d", keyspaceName, table, rowsPerRequest)
 	}
-	query := session.Query(request)
+	query := session.Query(request).RetryPolicy(retryPolicy).Observer(retryPolicy)
+
+	opType := "read"
+	if table == counterTableName {
+		opType = "counter_read"
+	}
 
-	RunTest(resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
+	RunTest(opType, table, resultChannel, workload, rateLimiter, func(rb *ResultBuilder) (error, time.Duration) {
 		pk := workload.NextPartitionKey()
 
 		var bound *gocql.Query
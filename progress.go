@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// ProgressReporter prints an ETA to completion for bounded workloads. It
+// smooths throughput with the same EWMA approach AdaptiveRateLimiter uses
+// for latency, since a naive remaining-ops / elapsed-time estimate is noisy
+// tick to tick.
+type ProgressReporter struct {
+	TotalOps int64
+	DoneOps  int64
+
+	alpha         float64
+	ewmaOpsPerSec float64
+}
+
+// NewProgressReporter returns a reporter for a workload of totalOps
+// operations. totalOps of 0 means unbounded, and Tick will never produce
+// an ETA for it.
+func NewProgressReporter(totalOps int64) *ProgressReporter {
+	return &ProgressReporter{TotalOps: totalOps, alpha: 0.1}
+}
+
+// Tick records opsSinceLastTick operations completed over elapsed, and
+// returns an ETA string, or "" if no ETA can be produced yet (unbounded
+// workload, or no throughput observed so far).
+func (pr *ProgressReporter) Tick(opsSinceLastTick int64, elapsed time.Duration) string {
+	pr.DoneOps += opsSinceLastTick
+	if elapsed <= 0 || pr.TotalOps == 0 {
+		return ""
+	}
+
+	opsPerSec := float64(opsSinceLastTick) / elapsed.Seconds()
+	if pr.ewmaOpsPerSec == 0 {
+		pr.ewmaOpsPerSec = opsPerSec
+	} else {
+		pr.ewmaOpsPerSec = pr.alpha*opsPerSec + (1-pr.alpha)*pr.ewmaOpsPerSec
+	}
+	if pr.ewmaOpsPerSec == 0 {
+		return ""
+	}
+
+	remaining := pr.TotalOps - pr.DoneOps
+	if remaining <= 0 {
+		return "ETA done"
+	}
+	eta := time.Duration(float64(remaining)/pr.ewmaOpsPerSec*float64(time.Second))
+	return fmt.Sprintf("ETA %s", eta.Round(time.Second))
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"strconv"
+	"time"
+)
+
+// resultRecord is the machine-readable shape of one partial or final tick,
+// shared by the JSON (one object per line) and CSV result formats.
+type resultRecord struct {
+	Timestamp             int64   `json:"ts"`
+	ElapsedSec            float64 `json:"elapsed_s"`
+	Ops                   int     `json:"ops"`
+	Rows                  int     `json:"rows"`
+	OpsPerSec             float64 `json:"ops_per_sec"`
+	RowsPerSec            float64 `json:"rows_per_sec"`
+	Errors                int     `json:"errors"`
+	P50Us                 float64 `json:"p50_us"`
+	P90Us                 float64 `json:"p90_us"`
+	P99Us                 float64 `json:"p99_us"`
+	P999Us                float64 `json:"p999_us"`
+	MaxUs                 float64 `json:"max_us"`
+	Final                 bool    `json:"final,omitempty"`
+	ErrorRecordingLatency bool    `json:"error_recording_latency,omitempty"`
+}
+
+var resultRecordCSVHeader = []string{
+	"ts", "elapsed_s", "ops", "rows", "ops_per_sec", "rows_per_sec",
+	"errors", "p50_us", "p90_us", "p99_us", "p999_us", "max_us", "final",
+}
+
+func newResultRecord(result *MergedResult, now time.Time) resultRecord {
+	rec := resultRecord{
+		Timestamp:  now.Unix(),
+		ElapsedSec: result.Time.Seconds(),
+		Ops:        result.Operations,
+		Rows:       result.ClusteringRows,
+		OpsPerSec:  result.OperationsPerSecond,
+		RowsPerSec: result.ClusteringRowsPerSecond,
+		Errors:     result.Errors,
+	}
+	if measureLatency && result.Latency != nil {
+		rec.P50Us = float64(result.Latency.ValueAtQuantile(50)) / 1000
+		rec.P90Us = float64(result.Latency.ValueAtQuantile(90)) / 1000
+		rec.P99Us = float64(result.Latency.ValueAtQuantile(99)) / 1000
+		rec.P999Us = float64(result.Latency.ValueAtQuantile(99.9)) / 1000
+		rec.MaxUs = float64(result.Latency.Max()) / 1000
+	}
+	return rec
+}
+
+func (rec resultRecord) csvRow() []string {
+	return []string{
+		strconv.FormatInt(rec.Timestamp, 10),
+		strconv.FormatFloat(rec.ElapsedSec, 'f', 3, 64),
+		strconv.Itoa(rec.Ops),
+		strconv.Itoa(rec.Rows),
+		strconv.FormatFloat(rec.OpsPerSec, 'f', 2, 64),
+		strconv.FormatFloat(rec.RowsPerSec, 'f', 2, 64),
+		strconv.Itoa(rec.Errors),
+		strconv.FormatFloat(rec.P50Us, 'f', 2, 64),
+		strconv.FormatFloat(rec.P90Us, 'f', 2, 64),
+		strconv.FormatFloat(rec.P99Us, 'f', 2, 64),
+		strconv.FormatFloat(rec.P999Us, 'f', 2, 64),
+		strconv.FormatFloat(rec.MaxUs, 'f', 2, 64),
+		strconv.FormatBool(rec.Final),
+	}
+}
+
+// ResultSink writes partial/final results in the format selected by
+// --result-format. It is unused (format "text") by default, in which case
+// RunConcurrently keeps calling PrintPartialResult as before.
+type ResultSink struct {
+	format      string
+	file        *os.File
+	closeFile   bool
+	csvWriter   *csv.Writer
+	wroteHeader bool
+}
+
+// NewResultSink opens path for format "json"/"csv" (or stdout, if path is
+// empty), and is a no-op sink for format "text".
+func NewResultSink(format, path string) (*ResultSink, error) {
+	if format == "text" {
+		return &ResultSink{format: format}, nil
+	}
+
+	file := os.Stdout
+	closeFile := false
+	if path != "" {
+		var err error
+		file, err = os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		closeFile = true
+	}
+
+	sink := &ResultSink{format: format, file: file, closeFile: closeFile}
+	if format == "csv" {
+		sink.csvWriter = csv.NewWriter(file)
+	}
+	return sink, nil
+}
+
+// Write emits one record for result. final marks the run's last record; in
+// the JSON format that record also has error_recording_latency, which is
+// omitted while errorRecordingLatency is false. CSV rows have no column for
+// errorRecordingLatency.
+func (s *ResultSink) Write(result *MergedResult, final bool) error {
+	if s.format == "text" {
+		return nil
+	}
+
+	rec := newResultRecord(result, time.Now())
+	rec.Final = final
+	if final {
+		rec.ErrorRecordingLatency = errorRecordingLatency
+	}
+
+	switch s.format {
+	case "json":
+		if err := json.NewEncoder(s.file).Encode(rec); err != nil {
+			return err
+		}
+	case "csv":
+		if !s.wroteHeader {
+			if err := s.csvWriter.Write(resultRecordCSVHeader); err != nil {
+				return err
+			}
+			s.wroteHeader = true
+		}
+		if err := s.csvWriter.Write(rec.csvRow()); err != nil {
+			return err
+		}
+		s.csvWriter.Flush()
+	}
+	return s.file.Sync()
+}
+
+func (s *ResultSink) Close() error {
+	if !s.closeFile {
+		return nil
+	}
+	return s.file.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/gocql/gocql"
+)
+
+// ConfigureRoutingPolicy points cluster at the token-aware, host-pool-aware
+// policy: each query is sent directly to a replica-owning coordinator
+// instead of round-robining across the whole cluster. If localDC is
+// non-empty, the fallback policy orders local-DC hosts before remote ones
+// (gocql.DCAwareRoundRobinPolicy), which is what lets ReplicaRetryPolicy's
+// DC-aware mode actually stay local before failing over.
+func ConfigureRoutingPolicy(cluster *gocql.ClusterConfig, localDC string) {
+	fallback := gocql.RoundRobinHostPolicy()
+	if localDC != "" {
+		fallback = gocql.DCAwareRoundRobinPolicy(localDC)
+	}
+	cluster.PoolConfig.HostSelectionPolicy = gocql.TokenAwareHostPolicy(fallback)
+}
+
+// ReplicaRetryPolicy is a gocql.RetryPolicy that retries Unavailable,
+// ReadTimeout and WriteTimeout errors against the next replica in ring
+// order: GetRetryType returns gocql.RetryNextHost, which advances
+// TokenAwareHostPolicy's query plan to the next host instead of re-hitting
+// the coordinator that just failed. In --dc-aware mode, ConfigureRoutingPolicy
+// orders that plan local-DC-first via DCAwareRoundRobinPolicy, so the first
+// LocalDCRetries attempts land on local replicas; Attempt widens the overall
+// budget to LocalDCRetries+ReplicaRetries so the plan can keep advancing
+// into remote-DC hosts once the local ones are exhausted.
+type ReplicaRetryPolicy struct {
+	ReplicaRetries int
+	DCAware        bool
+	LocalDCRetries int
+
+	mu         sync.Mutex
+	hostErrors map[string]uint64
+}
+
+// NewReplicaRetryPolicy builds a policy that allows up to replicaRetries
+// retries in ring order. If localDC is non-empty, DC-aware mode is enabled:
+// the first localDCRetries attempts are kept local before remote DCs are
+// allowed to be tried.
+func NewReplicaRetryPolicy(replicaRetries int, localDC string, localDCRetries int) *ReplicaRetryPolicy {
+	return &ReplicaRetryPolicy{
+		ReplicaRetries: replicaRetries,
+		DCAware:        localDC != "",
+		LocalDCRetries: localDCRetries,
+		hostErrors:     make(map[string]uint64),
+	}
+}
+
+func (p *ReplicaRetryPolicy) Attempt(q gocql.RetryableQuery) bool {
+	attempts := q.Attempts()
+	if p.DCAware {
+		return attempts <= p.LocalDCRetries+p.ReplicaRetries
+	}
+	return attempts <= p.ReplicaRetries
+}
+
+func (p *ReplicaRetryPolicy) GetRetryType(err error) gocql.RetryType {
+	switch err.(type) {
+	case *gocql.RequestErrUnavailable, *gocql.RequestErrReadTimeout, *gocql.RequestErrWriteTimeout:
+		return gocql.RetryNextHost
+	default:
+		return gocql.Rethrow
+	}
+}
+
+// ObserveQuery implements gocql.QueryObserver, which is how this policy
+// finds out which coordinator a failed attempt went to: gocql.RetryPolicy
+// only sees the error, not the host.
+func (p *ReplicaRetryPolicy) ObserveQuery(ctx context.Context, o gocql.ObservedQuery) {
+	if o.Err == nil || o.Host == nil {
+		return
+	}
+	p.recordHostError(o.Host.ConnectAddress().String())
+}
+
+// ObserveBatch implements gocql.BatchObserver, doing for batches what
+// ObserveQuery does for single queries.
+func (p *ReplicaRetryPolicy) ObserveBatch(ctx context.Context, o gocql.ObservedBatch) {
+	if o.Err == nil || o.Host == nil {
+		return
+	}
+	p.recordHostError(o.Host.ConnectAddress().String())
+}
+
+func (p *ReplicaRetryPolicy) recordHostError(host string) {
+	p.mu.Lock()
+	p.hostErrors[host]++
+	p.mu.Unlock()
+	hostErrorsTotal.WithLabelValues(host).Inc()
+}